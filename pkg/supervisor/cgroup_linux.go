@@ -0,0 +1,187 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cgroupV2Magic is the f_type reported by statfs(2) for the cgroup2
+// filesystem (see linux/magic.h).
+const cgroupV2Magic = 0x63677270
+
+// cgroupV2Available reports whether cgroup v2 (the unified hierarchy) is
+// mounted on this system.
+func cgroupV2Available() bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs("/sys/fs/cgroup", &stat); err != nil {
+		return false
+	}
+	return int64(stat.Type) == cgroupV2Magic
+}
+
+// cgroupPath returns the dedicated cgroup v2 scope for this supervisor.
+func (s *Supervisor) cgroupPath() string {
+	parent := s.Resources.CgroupParent
+	if parent == "" {
+		parent = DefaultCgroupParent
+	}
+	return filepath.Join(parent, s.Name+".scope")
+}
+
+// setupCgroup creates the process's dedicated cgroup and writes its limit
+// files, then arranges for cmd to be placed into it as it's forked, via
+// CLONE_INTO_CGROUP, so it's never running outside its limits, not even
+// briefly. It reports whether that worked; on false, the caller should fall
+// back to joinCgroup once the process has actually started.
+func (s *Supervisor) setupCgroup(cmd *exec.Cmd) bool {
+	if s.Resources.isZero() {
+		return false
+	}
+	if !cgroupV2Available() {
+		s.log.Debugf("cgroup v2 is not available, ignoring resource limits for %s", s.Name)
+		return false
+	}
+
+	path := s.cgroupPath()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		s.log.Debugf("failed to create cgroup %s: %v", path, err)
+		return false
+	}
+	for file, value := range s.Resources.limitFiles() {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+			s.log.Debugf("failed to write %s for %s: %v", file, s.Name, err)
+		}
+	}
+
+	dirFd, err := syscall.Open(path, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		s.log.Debugf("failed to open cgroup %s: %v", path, err)
+		return false
+	}
+
+	// Requires a kernel >= 5.7; on older kernels Start will fail with
+	// EINVAL, so the caller is expected to retry without this and fall back
+	// to joinCgroup.
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = dirFd
+	return true
+}
+
+// closeCgroupFD closes the directory fd opened by setupCgroup. The caller
+// owns it and must close it once Start has returned, successfully or not.
+func (s *Supervisor) closeCgroupFD(cmd *exec.Cmd) {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.UseCgroupFD {
+		if err := syscall.Close(cmd.SysProcAttr.CgroupFD); err != nil {
+			s.log.Debugf("failed to close cgroup fd for %s: %v", s.Name, err)
+		}
+	}
+}
+
+// joinCgroup is the fallback for kernels where CLONE_INTO_CGROUP isn't
+// available: move the already-started child into its cgroup after the
+// fact.
+func (s *Supervisor) joinCgroup(pid int) {
+	if s.Resources.isZero() || !cgroupV2Available() {
+		return
+	}
+	path := filepath.Join(s.cgroupPath(), "cgroup.procs")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		s.log.Debugf("failed to move pid %d into cgroup for %s: %v", pid, s.Name, err)
+	}
+}
+
+// removeCgroup cleans up the dedicated cgroup. The kernel refuses to rmdir
+// a non-empty cgroup, but by the time this runs the process has already
+// exited, so this is expected to succeed.
+func (s *Supervisor) removeCgroup() {
+	if s.Resources.isZero() {
+		return
+	}
+	if err := os.Remove(s.cgroupPath()); err != nil && !os.IsNotExist(err) {
+		s.log.Debugf("failed to remove cgroup for %s: %v", s.Name, err)
+	}
+}
+
+// ResourceUsage is a snapshot of the per-component metrics k0s surfaces for
+// cgroup-limited processes.
+type ResourceUsage struct {
+	MemoryCurrentBytes int64
+	PidsCurrent        int64
+	CPUStat            map[string]int64
+}
+
+// ResourceUsage reads memory.current, pids.current and cpu.stat from the
+// process's cgroup, so k0s can surface per-component resource metrics.
+func (s *Supervisor) ResourceUsage() (ResourceUsage, error) {
+	var usage ResourceUsage
+	if s.Resources.isZero() {
+		return usage, fmt.Errorf("%s has no resource limits configured", s.Name)
+	}
+	path := s.cgroupPath()
+
+	mem, err := readCgroupInt(filepath.Join(path, "memory.current"))
+	if err != nil {
+		return usage, err
+	}
+	usage.MemoryCurrentBytes = mem
+
+	pids, err := readCgroupInt(filepath.Join(path, "pids.current"))
+	if err != nil {
+		return usage, err
+	}
+	usage.PidsCurrent = pids
+
+	stat, err := readCgroupStat(filepath.Join(path, "cpu.stat"))
+	if err != nil {
+		return usage, err
+	}
+	usage.CPUStat = stat
+
+	return usage, nil
+}
+
+func readCgroupInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func readCgroupStat(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	stat := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			stat[fields[0]] = v
+		}
+	}
+	return stat, nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+//go:build linux
+
+package supervisor
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cgroupTestingAvailable records whether this environment can actually
+// create and populate a cgroup v2 scope, which needs both cgroup v2 mounted
+// and sufficient privilege/delegation. Computed once in TestMain so
+// individual tests can cheaply skip when it's not usable (e.g. in an
+// unprivileged CI container).
+var cgroupTestingAvailable bool
+
+func TestMain(m *testing.M) {
+	cgroupTestingAvailable = probeCgroupV2Writable()
+	os.Exit(m.Run())
+}
+
+func probeCgroupV2Writable() bool {
+	if !cgroupV2Available() {
+		return false
+	}
+	probe := filepath.Join(DefaultCgroupParent, "supervisor-cgroup-probe.scope")
+	if err := os.MkdirAll(probe, 0755); err != nil {
+		return false
+	}
+	defer os.Remove(probe)
+	return os.WriteFile(filepath.Join(probe, "pids.max"), []byte("max"), 0644) == nil
+}
+
+func TestCgroupResourceLimitsApplied(t *testing.T) {
+	if !cgroupTestingAvailable {
+		t.Skip("cgroup v2 is not available/writable in this environment")
+	}
+
+	sleepPath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Fatalf("could not find a path for 'sleep' executable: %s", err)
+	}
+
+	s := Supervisor{
+		Name:    "supervisor-test-cgroup",
+		BinPath: sleepPath,
+		RunDir:  ".",
+		Args:    []string{"5"},
+		Resources: Resources{
+			MemoryMax: 64 * 1024 * 1024,
+			PidsMax:   10,
+		},
+	}
+	if err := s.Supervise(); err != nil {
+		t.Fatalf("Failed to start %s: %v", s.Name, err)
+	}
+
+	path := s.cgroupPath()
+	data, err := os.ReadFile(filepath.Join(path, "memory.max"))
+	if err != nil {
+		t.Fatalf("failed to read memory.max: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != "67108864" {
+		t.Errorf("expected memory.max to be 67108864, got %q", data)
+	}
+
+	usage, err := s.ResourceUsage()
+	if err != nil {
+		t.Fatalf("ResourceUsage failed: %v", err)
+	}
+	if usage.PidsCurrent < 1 {
+		t.Errorf("expected at least 1 pid in the cgroup, got %d", usage.PidsCurrent)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("Failed to stop %s: %v", s.Name, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected cgroup %s to be removed after Stop", path)
+	}
+}
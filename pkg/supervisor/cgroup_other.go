@@ -0,0 +1,47 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+//go:build !linux
+
+package supervisor
+
+import "os/exec"
+
+// setupCgroup is a no-op on platforms without cgroup v2.
+func (s *Supervisor) setupCgroup(cmd *exec.Cmd) bool {
+	if !s.Resources.isZero() {
+		s.log.Debugf("cgroup resource limits are not supported on this platform, ignoring for %s", s.Name)
+	}
+	return false
+}
+
+func (s *Supervisor) joinCgroup(pid int) {}
+
+// closeCgroupFD is a no-op on platforms without cgroup v2.
+func (s *Supervisor) closeCgroupFD(cmd *exec.Cmd) {}
+
+func (s *Supervisor) removeCgroup() {}
+
+// ResourceUsage is a snapshot of the per-component metrics k0s surfaces for
+// cgroup-limited processes. Always empty on this platform.
+type ResourceUsage struct {
+	MemoryCurrentBytes int64
+	PidsCurrent        int64
+	CPUStat            map[string]int64
+}
+
+func (s *Supervisor) ResourceUsage() (ResourceUsage, error) {
+	return ResourceUsage{}, errUnsupported
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package supervisor
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// HealthCheck performs a single probe of a supervised process and reports
+// whether it's healthy. Implementations mirror Kubernetes probe semantics,
+// which is the vocabulary k0s's own components (kubelet, etcd,
+// konnectivity, ...) are already built around.
+type HealthCheck interface {
+	Check() error
+}
+
+// Probe schedules a HealthCheck the same way a Kubernetes readiness or
+// liveness probe would: wait InitialDelay, then run Check every Period,
+// bounding each attempt by Timeout, and requiring SuccessThreshold
+// consecutive passes (or FailureThreshold consecutive failures) before the
+// result is acted on. Zero values fall back to sane Kubernetes-like
+// defaults.
+type Probe struct {
+	Check HealthCheck
+
+	InitialDelay     time.Duration
+	Period           time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+	SuccessThreshold int
+}
+
+func (p *Probe) period() time.Duration {
+	if p.Period <= 0 {
+		return 10 * time.Second
+	}
+	return p.Period
+}
+
+func (p *Probe) successThreshold() int {
+	if p.SuccessThreshold <= 0 {
+		return 1
+	}
+	return p.SuccessThreshold
+}
+
+func (p *Probe) failureThreshold() int {
+	if p.FailureThreshold <= 0 {
+		return 3
+	}
+	return p.FailureThreshold
+}
+
+// run executes p.Check, bounding it by p.Timeout if set.
+func (p *Probe) run() error {
+	if p.Timeout <= 0 {
+		return p.Check.Check()
+	}
+	result := make(chan error, 1)
+	go func() { result <- p.Check.Check() }()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(p.Timeout):
+		return fmt.Errorf("probe timed out after %s", p.Timeout)
+	}
+}
+
+// HTTPGetCheck probes by issuing an HTTP GET and treating any 2xx response
+// as healthy, mirroring a Kubernetes httpGet probe.
+type HTTPGetCheck struct {
+	URL    string
+	Client *http.Client
+}
+
+func (c *HTTPGetCheck) Check() error {
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(c.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("GET %s: unhealthy status %s", c.URL, resp.Status)
+	}
+	return nil
+}
+
+// TCPConnectCheck probes by attempting to open a TCP connection, mirroring
+// a Kubernetes tcpSocket probe.
+type TCPConnectCheck struct {
+	Address string
+	Timeout time.Duration
+}
+
+func (c *TCPConnectCheck) Check() error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", c.Address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// ExecCheck probes by running a command and treating a zero exit code as
+// healthy, mirroring a Kubernetes exec probe.
+type ExecCheck struct {
+	Command string
+	Args    []string
+}
+
+func (c *ExecCheck) Check() error {
+	return exec.Command(c.Command, c.Args...).Run()
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package supervisor
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// pidFilePath returns the path of the file that persists the pid and
+// liveness metadata of the supervised process across k0s restarts.
+func (s *Supervisor) pidFilePath() string {
+	return filepath.Join(s.RunDir, s.Name+".pid")
+}
+
+// hashArgv returns a stable, short fingerprint of an argv, used to recognize
+// whether a pid we're about to adopt still runs the command we expect.
+func hashArgv(argv []string) string {
+	h := fnv.New64a()
+	for _, a := range argv {
+		fmt.Fprint(h, a, "\x00")
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// writePIDFile persists the pid, process start time and argv hash of the
+// currently running process, so a future Supervisor for the same Name can
+// adopt it instead of spawning a new one.
+func (s *Supervisor) writePIDFile() error {
+	pid := s.cmd.Process.Pid
+	startTime, err := readProcStartTime(pid)
+	if err != nil {
+		// Not fatal, we just won't be able to validate the start time on
+		// adoption and will fall back to a plain liveness check.
+		s.log.Debugf("failed to read start time for pid %d: %v", pid, err)
+	}
+	argv := append([]string{s.BinPath}, s.Args...)
+	contents := fmt.Sprintf("%d\n%s\n%s\n", pid, startTime, hashArgv(argv))
+	return os.WriteFile(s.pidFilePath(), []byte(contents), 0644)
+}
+
+// removePIDFile removes the persisted pid file, ignoring a not-exist error.
+func (s *Supervisor) removePIDFile() {
+	if err := os.Remove(s.pidFilePath()); err != nil && !os.IsNotExist(err) {
+		s.log.Warnf("failed to remove pid file %s: %v", s.pidFilePath(), err)
+	}
+}
+
+// readPIDFile parses a previously written pid file.
+func readPIDFile(path string) (pid int, startTime string, argvHash string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, "", "", err
+	}
+	lines := strings.SplitN(strings.TrimRight(string(data), "\n"), "\n", 3)
+	if len(lines) != 3 {
+		return 0, "", "", fmt.Errorf("malformed pid file %s", path)
+	}
+	pid, err = strconv.Atoi(lines[0])
+	if err != nil {
+		return 0, "", "", fmt.Errorf("malformed pid file %s: %w", path, err)
+	}
+	return pid, lines[1], lines[2], nil
+}
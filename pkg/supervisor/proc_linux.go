@@ -0,0 +1,56 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readProcStartTime returns the process start time (field 22 of
+// /proc/<pid>/stat, in clock ticks since boot) as a string. It is used as a
+// cheap fingerprint to tell a still-running process apart from an unrelated
+// one that happens to have been recycled onto the same pid.
+func readProcStartTime(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", err
+	}
+	// The 2nd field (comm) is parenthesized and may itself contain spaces or
+	// parens, so locate the end of it by its closing paren rather than by
+	// splitting on spaces from the start.
+	closeParen := strings.LastIndexByte(string(data), ')')
+	if closeParen < 0 {
+		return "", fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data)[closeParen+1:])
+	// fields[0] is the 3rd stat field (state), so the 22nd field is at index 19.
+	const startTimeIndex = 22 - 3
+	if len(fields) <= startTimeIndex {
+		return "", fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return fields[startTimeIndex], nil
+}
+
+// readProcCmdline returns the argv of pid as recorded by the kernel.
+func readProcCmdline(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+}
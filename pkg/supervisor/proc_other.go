@@ -0,0 +1,33 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+//go:build !linux
+
+package supervisor
+
+import "errors"
+
+// errUnsupported is returned by the proc helpers on platforms that don't
+// have a /proc filesystem to cross-check process identity with. Adoption
+// falls back to a plain liveness check there.
+var errUnsupported = errors.New("not supported on this platform")
+
+func readProcStartTime(pid int) (string, error) {
+	return "", errUnsupported
+}
+
+func readProcCmdline(pid int) ([]string, error) {
+	return nil, errUnsupported
+}
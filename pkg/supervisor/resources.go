@@ -0,0 +1,71 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package supervisor
+
+import "strconv"
+
+// DefaultCgroupParent is used when Resources.CgroupParent is left empty.
+const DefaultCgroupParent = "/sys/fs/cgroup/k0s.slice"
+
+// Resources describes cgroup v2 resource limits to apply to the supervised
+// process. It's only enforced on Linux with cgroup v2 mounted; elsewhere
+// it's silently ignored. Fields left at their zero value impose no limit.
+type Resources struct {
+	// CgroupParent is the parent cgroup v2 slice the process's own scope is
+	// created under. Defaults to DefaultCgroupParent.
+	CgroupParent string
+
+	CPUMax    string // cpu.max, e.g. "100000 1000000"
+	CPUWeight uint64 // cpu.weight
+
+	MemoryMax  int64 // memory.max, in bytes
+	MemoryHigh int64 // memory.high, in bytes
+
+	PidsMax int64 // pids.max
+
+	IOMax string // io.max, e.g. "8:0 rbps=1048576"
+}
+
+func (r *Resources) isZero() bool {
+	return r.CPUMax == "" && r.CPUWeight == 0 &&
+		r.MemoryMax == 0 && r.MemoryHigh == 0 &&
+		r.PidsMax == 0 && r.IOMax == ""
+}
+
+// limitFiles returns the cgroup v2 control files to write for the
+// configured limits, keyed by file name relative to the cgroup directory.
+func (r *Resources) limitFiles() map[string]string {
+	files := make(map[string]string)
+	if r.CPUMax != "" {
+		files["cpu.max"] = r.CPUMax
+	}
+	if r.CPUWeight != 0 {
+		files["cpu.weight"] = strconv.FormatUint(r.CPUWeight, 10)
+	}
+	if r.MemoryMax != 0 {
+		files["memory.max"] = strconv.FormatInt(r.MemoryMax, 10)
+	}
+	if r.MemoryHigh != 0 {
+		files["memory.high"] = strconv.FormatInt(r.MemoryHigh, 10)
+	}
+	if r.PidsMax != 0 {
+		files["pids.max"] = strconv.FormatInt(r.PidsMax, 10)
+	}
+	if r.IOMax != "" {
+		files["io.max"] = r.IOMax
+	}
+	return files
+}
@@ -0,0 +1,646 @@
+/*
+Copyright 2022 k0s authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrStopTimeout is returned by Stop when the process did not exit within
+// TimeoutStop after being sent StopSignal, and had to be killed with
+// SIGKILL instead.
+var ErrStopTimeout = errors.New("process did not stop in time, had to be killed")
+
+// Supervisor is dead simple and stupid process supervisor, just tries to keep the process running in a while-true loop
+type Supervisor struct {
+	Name    string
+	BinPath string
+	RunDir  string
+	Args    []string
+	Uid     int
+	Gid     int
+
+	// For those components having env prefix convention i.e. ETCD_xxx
+	EnvPrefix     string
+	KeepEnvPrefix bool
+
+	TimeoutRespawn time.Duration
+
+	// TimeoutStop bounds how long Stop waits for StopSignal to take effect
+	// before escalating to SIGKILL. Defaults to 5 seconds.
+	TimeoutStop time.Duration
+	// StopSignal is the signal sent to the process group on Stop. Defaults
+	// to SIGTERM.
+	StopSignal os.Signal
+
+	// RespawnBackoff configures the delay before a respawn attempt; a zero
+	// value keeps the original fixed TimeoutRespawn delay.
+	RespawnBackoff RespawnBackoff
+	// RespawnResetAfter resets the backoff to RespawnBackoff.Initial once
+	// the process has stayed up for at least this long.
+	RespawnResetAfter time.Duration
+
+	// MaxRestarts and RestartWindow implement a crash-loop circuit breaker:
+	// if the process crashes MaxRestarts times within RestartWindow, the
+	// supervisor stops respawning it and surfaces the last exit error via
+	// Wait. Zero values disable the breaker and respawn forever, as before.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	// ReadinessProbe gates Ready: it isn't closed until the probe passes.
+	// LivenessProbe, once FailureThreshold consecutive checks fail, kills
+	// the process and lets the normal respawn path take over. Either may be
+	// left nil to skip that kind of check.
+	ReadinessProbe *Probe
+	LivenessProbe  *Probe
+
+	// Resources configures cgroup v2 limits for the process. Linux-only;
+	// ignored elsewhere or when cgroup v2 isn't mounted.
+	Resources Resources
+
+	cmd         *exec.Cmd
+	adopted     bool
+	detach      bool
+	stopping    bool
+	quit        chan struct{}
+	done        chan struct{}
+	doneErr     error
+	stopErr     error
+	lastExitErr error
+	crashes     []time.Time
+	ready       chan struct{}
+	genQuit     chan struct{}
+	log         *logrus.Entry
+	mutex       sync.Mutex
+}
+
+// Supervise starts the process and goes into a respawn loop that restarts it
+// whenever it exits unexpectedly. Supervise returns as soon as the process
+// has been started; use Stop to shut it down again.
+func (s *Supervisor) Supervise() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.log = logrus.WithField("component", s.Name)
+	// Default respawn timeout to 5 sec
+	if s.TimeoutRespawn == 0 {
+		s.TimeoutRespawn = 5 * time.Second
+	}
+
+	if err := os.MkdirAll(s.RunDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", s.RunDir, err)
+	}
+
+	stat, err := os.Stat(s.BinPath)
+	if err != nil {
+		return fmt.Errorf("failed to locate %s: %w", s.BinPath, err)
+	}
+	if stat.IsDir() || stat.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", s.BinPath)
+	}
+
+	logfileName := filepath.Join(s.RunDir, s.Name+".log")
+	logWriter, err := os.OpenFile(logfileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %w", logfileName, err)
+	}
+
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+
+	if process := s.adopt(); process != nil {
+		s.cmd = &exec.Cmd{Path: s.BinPath, Args: append([]string{s.BinPath}, s.Args...), Process: process}
+		s.adopted = true
+		s.startLivenessProbe()
+	} else if err := s.startProcess(logWriter); err != nil {
+		logWriter.Close()
+		return err
+	}
+
+	s.ready = make(chan struct{})
+	if s.ReadinessProbe == nil {
+		close(s.ready)
+	} else {
+		go s.runReadinessProbe(s.ReadinessProbe)
+	}
+
+	go s.supervise(logWriter)
+
+	return nil
+}
+
+// Ready returns a channel that is closed once the process has passed
+// ReadinessProbe (or immediately, if none is configured). Components that
+// depend on this one should wait on it instead of assuming the process is
+// usable as soon as it's running.
+func (s *Supervisor) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// startLivenessProbe (re)starts the liveness-probe goroutine for the
+// currently running process, stopping whichever one was watching the
+// previous generation, if any. Must be called with s.mutex held.
+func (s *Supervisor) startLivenessProbe() {
+	if s.genQuit != nil {
+		close(s.genQuit)
+		s.genQuit = nil
+	}
+	if s.LivenessProbe == nil {
+		return
+	}
+	s.genQuit = make(chan struct{})
+	go s.runLivenessProbe(s.LivenessProbe, s.genQuit, s.cmd.Process.Pid)
+}
+
+// runReadinessProbe polls probe until SuccessThreshold consecutive checks
+// pass, then closes s.ready. It runs once per Supervise call, independent of
+// any later respawns.
+func (s *Supervisor) runReadinessProbe(probe *Probe) {
+	threshold := probe.successThreshold()
+	successes := 0
+	timer := time.NewTimer(probe.InitialDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-timer.C:
+		}
+
+		if probe.run() == nil {
+			successes++
+			if successes >= threshold {
+				close(s.ready)
+				return
+			}
+		} else {
+			successes = 0
+		}
+		timer.Reset(probe.period())
+	}
+}
+
+// runLivenessProbe polls probe against the process identified by pid until
+// either genQuit or s.quit fires, or FailureThreshold consecutive checks
+// fail, in which case it kills the process group so the normal respawn path
+// takes over.
+func (s *Supervisor) runLivenessProbe(probe *Probe, genQuit <-chan struct{}, pid int) {
+	threshold := probe.failureThreshold()
+	failures := 0
+	timer := time.NewTimer(probe.InitialDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-genQuit:
+			return
+		case <-s.quit:
+			return
+		case <-timer.C:
+		}
+
+		if err := probe.run(); err != nil {
+			failures++
+			s.log.Warnf("liveness probe failed (%d/%d) for pid %d: %v", failures, threshold, pid, err)
+			if failures >= threshold {
+				s.log.Warnf("liveness probe exhausted, killing pid %d", pid)
+				if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
+					s.log.Warnf("failed to kill pid %d: %v", pid, err)
+				}
+				return
+			}
+		} else {
+			failures = 0
+		}
+		timer.Reset(probe.period())
+	}
+}
+
+// adopt tries to re-attach to a process that was left running by an earlier
+// Supervisor instance for the same Name (e.g. across a `k0s stop`/restart),
+// so that a healthy child isn't needlessly killed and respawned. It returns
+// the adopted process, or nil if there was nothing to adopt, in which case
+// the caller should fall through to a normal spawn.
+func (s *Supervisor) adopt() *os.Process {
+	path := s.pidFilePath()
+	pid, startTime, argvHash, err := readPIDFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log.Warnf("failed to read pid file %s: %v", path, err)
+		}
+		return nil
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		s.log.Debugf("pid %d from pid file not found: %v", pid, err)
+		s.removePIDFile()
+		return nil
+	}
+	if err := process.Signal(syscall.Signal(0)); err != nil {
+		s.log.Debugf("pid %d from pid file is not alive: %v", pid, err)
+		s.removePIDFile()
+		return nil
+	}
+	if !verifyProcessIdentity(pid, startTime, argvHash, s.BinPath, s.Args) {
+		s.log.Infof("pid %d from pid file looks recycled, not adopting", pid)
+		s.removePIDFile()
+		return nil
+	}
+
+	s.log.Infof("adopted already-running process with pid %d", pid)
+	return process
+}
+
+// verifyProcessIdentity cross-checks that pid is still the process we
+// expect, by comparing its current start time and cmdline fingerprint
+// against what was recorded in the pid file. On platforms without /proc
+// this can't be verified, so we trust the liveness check the caller already
+// performed.
+func verifyProcessIdentity(pid int, wantStartTime, wantArgvHash, binPath string, args []string) bool {
+	gotStartTime, err := readProcStartTime(pid)
+	if err != nil {
+		return true
+	}
+	if wantStartTime == "" || gotStartTime != wantStartTime {
+		return false
+	}
+
+	cmdline, err := readProcCmdline(pid)
+	if err != nil {
+		return false
+	}
+	return hashArgv(cmdline) == wantArgvHash
+}
+
+// supervise is run in its own goroutine, it waits for the process to exit
+// and respawns it until told to quit, or until the crash-loop breaker trips.
+func (s *Supervisor) supervise(logWriter *os.File) {
+	defer logWriter.Close()
+	defer close(s.done)
+	defer func() {
+		s.mutex.Lock()
+		if s.genQuit != nil {
+			close(s.genQuit)
+			s.genQuit = nil
+		}
+		s.mutex.Unlock()
+	}()
+
+	startedAt := time.Now()
+	var backoff time.Duration
+
+	for {
+		shuttingDown, err := s.waitOrQuit()
+		if shuttingDown {
+			s.doneErr = err
+			s.stopErr = err
+			return
+		}
+
+		if s.recordCrash(time.Now()) {
+			s.log.Errorf("crashed %d times within %s, giving up", s.MaxRestarts, s.RestartWindow)
+			s.doneErr = s.lastExitErr
+			return
+		}
+
+		if s.RespawnResetAfter > 0 && time.Since(startedAt) >= s.RespawnResetAfter {
+			backoff = 0
+		}
+		wait := s.nextRespawnDelay(&backoff)
+
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(wait):
+			s.log.Info("respawning")
+		}
+
+		s.mutex.Lock()
+		startedAt = time.Now()
+		err = s.startProcess(logWriter)
+		s.mutex.Unlock()
+		if err != nil {
+			s.log.Warnf("failed to respawn: %s", err)
+		}
+	}
+}
+
+// waitOrQuit waits for the current process to exit, or for quit to be
+// closed, whichever happens first. The first return value reports whether
+// the supervisor is shutting down; the second is a non-nil error only when
+// shutting down required escalating to SIGKILL.
+func (s *Supervisor) waitOrQuit() (bool, error) {
+	process := s.cmd.Process
+	var waitResult <-chan error
+	if s.adopted {
+		// We didn't fork this process ourselves, so we can't exec.Cmd.Wait()
+		// on it; poll its liveness instead.
+		waitResult = pollLiveness(process, time.Second)
+	} else {
+		cmd := s.cmd
+		ch := make(chan error, 1)
+		go func() { ch <- cmd.Wait() }()
+		waitResult = ch
+	}
+
+	select {
+	case err := <-waitResult:
+		s.log.Warnf("process exited: %v", err)
+		s.adopted = false
+		s.lastExitErr = err
+		s.removePIDFile()
+		return false, nil
+	case <-s.quit:
+		if s.detach {
+			s.log.Infof("detaching from pid %d, leaving it running", process.Pid)
+			return true, nil
+		}
+		err := s.terminate(process, waitResult)
+		s.removePIDFile()
+		return true, err
+	}
+}
+
+// pollLiveness periodically checks whether an adopted process is still
+// alive, since we can't Wait() on a process we didn't fork ourselves.
+func pollLiveness(process *os.Process, interval time.Duration) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		for {
+			if err := process.Signal(syscall.Signal(0)); err != nil {
+				result <- err
+				return
+			}
+			time.Sleep(interval)
+		}
+	}()
+	return result
+}
+
+// terminate sends StopSignal to the process group and waits up to
+// TimeoutStop for it to exit; if it hasn't by then, it escalates to SIGKILL
+// and returns ErrStopTimeout.
+func (s *Supervisor) terminate(process *os.Process, waitResult <-chan error) error {
+	pid := process.Pid
+	stopSignal := s.StopSignal
+	if stopSignal == nil {
+		stopSignal = syscall.SIGTERM
+	}
+	timeoutStop := s.TimeoutStop
+	if timeoutStop == 0 {
+		timeoutStop = 5 * time.Second
+	}
+
+	s.log.Infof("shutting down pid %d with %s", pid, stopSignal)
+	if err := signalGroup(pid, stopSignal); err != nil {
+		s.log.Warnf("failed to signal pid %d: %v", pid, err)
+	}
+
+	select {
+	case <-waitResult:
+		return nil
+	case <-time.After(timeoutStop):
+	}
+
+	s.log.Warnf("pid %d did not stop within %s, sending SIGKILL", pid, timeoutStop)
+	if err := signalGroup(pid, syscall.SIGKILL); err != nil {
+		s.log.Warnf("failed to send SIGKILL to pid %d: %v", pid, err)
+	}
+
+	select {
+	case <-waitResult:
+	case <-time.After(5 * time.Second):
+		s.log.Warnf("pid %d still not gone after SIGKILL", pid)
+	}
+	return ErrStopTimeout
+}
+
+// signalGroup sends sig to the process group led by pid.
+func signalGroup(pid int, sig os.Signal) error {
+	sysSig, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal type %T", sig)
+	}
+	return syscall.Kill(-pid, sysSig)
+}
+
+// buildCmd assembles the exec.Cmd used to start the supervised process,
+// without touching cgroups.
+func (s *Supervisor) buildCmd(logWriter *os.File) *exec.Cmd {
+	cmd := exec.Command(s.BinPath, s.Args...)
+	cmd.Dir = s.RunDir
+	cmd.Stdout = logWriter
+	cmd.Stderr = logWriter
+	cmd.Env = getEnv(s.RunDir, s.EnvPrefix, s.KeepEnvPrefix)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	if s.Uid != 0 || s.Gid != 0 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid: uint32(s.Uid),
+			Gid: uint32(s.Gid),
+		}
+	}
+	return cmd
+}
+
+// startProcess execs BinPath with Args and wires its output to logWriter. It
+// must be called with s.mutex held.
+func (s *Supervisor) startProcess(logWriter *os.File) error {
+	s.cmd = s.buildCmd(logWriter)
+	joinedAtStart := s.setupCgroup(s.cmd)
+
+	err := s.cmd.Start()
+	s.closeCgroupFD(s.cmd)
+	if err != nil && joinedAtStart {
+		// The kernel may not support CLONE_INTO_CGROUP (requires >= 5.7), in
+		// which case Start fails with EINVAL; fall back to starting
+		// normally and joining the cgroup after the fact.
+		s.log.Warnf("failed to start %s with CLONE_INTO_CGROUP, falling back to joining the cgroup after start: %v", s.BinPath, err)
+		s.cmd = s.buildCmd(logWriter)
+		joinedAtStart = false
+		err = s.cmd.Start()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", s.BinPath, err)
+	}
+	s.adopted = false
+	s.log.Infof("started: %d", s.cmd.Process.Pid)
+	if !joinedAtStart {
+		s.joinCgroup(s.cmd.Process.Pid)
+	}
+	if err := s.writePIDFile(); err != nil {
+		s.log.Warnf("failed to write pid file: %v", err)
+	}
+	s.startLivenessProbe()
+	return nil
+}
+
+// Stop stops the supervised process, waiting for the respawn loop to shut
+// down before returning. It is a no-op if the process was never started.
+func (s *Supervisor) Stop() error {
+	return s.shutdown(false)
+}
+
+// Detach stops supervising the process without killing it, leaving its pid
+// file in place so that a future Supervisor for the same Name can adopt it.
+// This lets daemonized components survive a `k0s stop`.
+func (s *Supervisor) Detach() error {
+	return s.shutdown(true)
+}
+
+func (s *Supervisor) shutdown(detach bool) error {
+	s.mutex.Lock()
+	if s.quit == nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	if s.stopping {
+		s.mutex.Unlock()
+		<-s.done
+		return s.doneErr
+	}
+	s.stopping = true
+	s.detach = detach
+	s.mutex.Unlock()
+
+	// s.quit itself is never nil'ed out and is closed exactly once here, so
+	// every select on it elsewhere keeps observing the same channel instead
+	// of racing a nil'ed-out field.
+	close(s.quit)
+	<-s.done
+	if !detach {
+		s.removeCgroup()
+	}
+	// stopErr is only set when Stop/Detach actually had to shut the process
+	// down; if the breaker had already tripped on its own, there's nothing
+	// for Stop to report and it returns nil. Use Wait to learn why
+	// supervision ended.
+	return s.stopErr
+}
+
+// Wait blocks until the supervisor stops supervising the process - either
+// because Stop/Detach was called, or because the crash-loop breaker tripped
+// after MaxRestarts failures within RestartWindow - and returns why: nil on
+// a clean Stop, ErrStopTimeout if SIGKILL was needed, or the process's last
+// exit error if the breaker tripped.
+func (s *Supervisor) Wait() error {
+	<-s.done
+	return s.doneErr
+}
+
+// GetProcess returns the os.Process of the currently supervised process, or
+// nil if Supervise hasn't been called yet.
+func (s *Supervisor) GetProcess() *os.Process {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cmd == nil {
+		return nil
+	}
+	return s.cmd.Process
+}
+
+// proxyEnvVars are always overridden by their prefixed counterpart and never
+// kept in their prefixed form, regardless of keepEnvPrefix, so that a
+// per-component proxy override (e.g. ETCD_HTTPS_PROXY) reliably takes effect
+// even for components that otherwise want to keep seeing their prefixed
+// vars untouched.
+var proxyEnvVars = map[string]bool{
+	"HTTP_PROXY":  true,
+	"HTTPS_PROXY": true,
+	"NO_PROXY":    true,
+}
+
+// getEnv returns the environment to run the supervised process in. Variables
+// prefixed with prefix override their unprefixed counterpart (stripping the
+// prefix); when keepEnvPrefix is set the prefixed variable is kept as well
+// instead of being applied as an override, except for proxyEnvVars, which
+// are always applied as overrides. PATH always gets dataDir/bin prepended so
+// components can find k0s-managed binaries.
+func getEnv(dataDir string, prefix string, keepEnvPrefix bool) []string {
+	env := os.Environ()
+	overrides := make(map[string]string)
+	var result []string
+
+	envPrefix := ""
+	if prefix != "" {
+		envPrefix = strings.ToUpper(prefix) + "_"
+	}
+
+	if envPrefix != "" {
+		for _, e := range env {
+			kv := strings.SplitN(e, "=", 2)
+			if !strings.HasPrefix(kv[0], envPrefix) {
+				continue
+			}
+			key := strings.TrimPrefix(kv[0], envPrefix)
+			if proxyEnvVars[key] || !keepEnvPrefix {
+				overrides[key] = kv[1]
+			}
+		}
+	}
+
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		key := kv[0]
+		if key == "PATH" {
+			continue
+		}
+		if envPrefix != "" && strings.HasPrefix(key, envPrefix) {
+			trimmed := strings.TrimPrefix(key, envPrefix)
+			if keepEnvPrefix && !proxyEnvVars[trimmed] {
+				result = append(result, e)
+			}
+			continue
+		}
+		if _, overridden := overrides[key]; overridden {
+			// Dropped here so the override from the overrides map below is
+			// the only entry for this key; keeping both would leave the
+			// unprefixed value shadowing the override in the child's envp.
+			continue
+		}
+		result = append(result, e)
+	}
+
+	for k, v := range overrides {
+		if k == "PATH" {
+			// PATH is handled specially below, since it also gets
+			// dataDir/bin prepended.
+			continue
+		}
+		result = append(result, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	path := "PATH=" + filepath.Join(dataDir, "bin") + ":"
+	if p, ok := overrides["PATH"]; ok {
+		path += p
+	} else {
+		path += os.Getenv("PATH")
+	}
+	result = append(result, path)
+
+	return result
+}
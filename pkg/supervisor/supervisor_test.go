@@ -17,6 +17,8 @@ package supervisor
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"sort"
@@ -173,6 +175,7 @@ func TestStopWhileRespawn(t *testing.T) {
 		RunDir:         ".",
 		Args:           []string{},
 		TimeoutRespawn: 1 * time.Second,
+		TimeoutStop:    1 * time.Second,
 	}
 	err = s.Supervise()
 	if err != nil {
@@ -186,8 +189,338 @@ func TestStopWhileRespawn(t *testing.T) {
 	}
 
 	// try stop while waiting for respawn
+	start := time.Now()
 	err = s.Stop()
 	if err != nil {
 		t.Errorf("Failed to stop %s: %v", s.Name, err)
 	}
+	if elapsed := time.Since(start); elapsed > s.TimeoutStop+2*time.Second {
+		t.Errorf("Stop took too long to return: %s", elapsed)
+	}
+}
+
+func TestStopEscalatesToSIGKILL(t *testing.T) {
+	dir := t.TempDir()
+	ready := dir + "/ready"
+	s := Supervisor{
+		Name:        "supervisor-test-stop-escalate",
+		BinPath:     "/bin/sh",
+		RunDir:      ".",
+		Args:        []string{"-c", fmt.Sprintf(`trap "" TERM; touch %s; sleep 60`, ready)},
+		TimeoutStop: 200 * time.Millisecond,
+	}
+	if err := s.Supervise(); err != nil {
+		t.Errorf("Failed to start %s: %v", s.Name, err)
+	}
+	process := s.GetProcess()
+
+	// Wait for the shell to have installed its trap before signalling it:
+	// until then, TERM's default disposition would kill it (and its child)
+	// outright, never exercising the escalation path this test is for.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(ready); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process never reached the trap, sentinel file %s was not created", ready)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	start := time.Now()
+	err := s.Stop()
+	elapsed := time.Since(start)
+
+	if err != ErrStopTimeout {
+		t.Errorf("Expected ErrStopTimeout, got %v", err)
+	}
+	if elapsed > s.TimeoutStop+5*time.Second {
+		t.Errorf("Stop took too long to escalate: %s", elapsed)
+	}
+	if err := process.Signal(syscall.Signal(0)); err == nil {
+		t.Errorf("Expected pid %d to have been killed by SIGKILL", process.Pid)
+	}
+}
+
+func TestRespawnBackoffSequence(t *testing.T) {
+	s := &Supervisor{
+		RespawnBackoff: RespawnBackoff{
+			Initial:    10 * time.Millisecond,
+			Max:        80 * time.Millisecond,
+			Multiplier: 2,
+		},
+	}
+
+	want := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+		80 * time.Millisecond, // capped at Max
+	}
+	var backoff time.Duration
+	for i, w := range want {
+		if got := s.nextRespawnDelay(&backoff); got != w {
+			t.Errorf("step %d: got %s, want %s", i, got, w)
+		}
+	}
+}
+
+func TestApplyJitterStaysWithinBounds(t *testing.T) {
+	d := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		got := applyJitter(d, 0.2)
+		if got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Errorf("jittered delay %s out of [80ms, 120ms] bounds", got)
+		}
+	}
+}
+
+func TestRespawnBackoffResetsAfterStableRun(t *testing.T) {
+	shPath, err := exec.LookPath("sh")
+	if err != nil {
+		t.Errorf("could not find a path for 'sh' executable: %s", err)
+	}
+
+	s := Supervisor{
+		Name:    "supervisor-test-backoff-reset",
+		BinPath: shPath,
+		RunDir:  ".",
+		Args:    []string{"-c", "sleep 0.05"},
+		RespawnBackoff: RespawnBackoff{
+			Initial:    20 * time.Millisecond,
+			Max:        500 * time.Millisecond,
+			Multiplier: 4,
+		},
+		RespawnResetAfter: 40 * time.Millisecond,
+	}
+	if err := s.Supervise(); err != nil {
+		t.Errorf("Failed to start %s: %v", s.Name, err)
+	}
+
+	// Each run stays up longer than RespawnResetAfter, so the backoff should
+	// keep getting reset to Initial instead of climbing toward Max; sample
+	// pids for a second and expect many more respawns than an ever-growing
+	// backoff would allow.
+	pids := map[int]bool{}
+	deadline := time.Now().Add(1 * time.Second)
+	for time.Now().Before(deadline) {
+		if p := s.GetProcess(); p != nil {
+			pids[p.Pid] = true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("Failed to stop %s: %v", s.Name, err)
+	}
+	if len(pids) < 4 {
+		t.Errorf("expected several respawns if backoff kept resetting, saw %d distinct pids", len(pids))
+	}
+}
+
+func TestCrashLoopBreakerTrips(t *testing.T) {
+	falsePath, err := exec.LookPath("false")
+	if err != nil {
+		t.Errorf("could not find a path for 'false' executable: %s", err)
+	}
+
+	s := Supervisor{
+		Name:           "supervisor-test-crashloop",
+		BinPath:        falsePath,
+		RunDir:         ".",
+		TimeoutRespawn: 10 * time.Millisecond,
+		MaxRestarts:    3,
+		RestartWindow:  1 * time.Second,
+	}
+	if err := s.Supervise(); err != nil {
+		t.Errorf("Failed to start %s: %v", s.Name, err)
+	}
+
+	if err := s.Wait(); err == nil {
+		t.Errorf("Expected Wait to return the last exit error once the breaker tripped")
+	}
+
+	// The supervisor has already given up; Stop should be a cheap no-op.
+	if err := s.Stop(); err != nil {
+		t.Errorf("Failed to stop %s: %v", s.Name, err)
+	}
+}
+
+func TestReadinessProbeWaitsForPort(t *testing.T) {
+	sleepPath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Errorf("could not find a path for 'sleep' executable: %s", err)
+	}
+
+	// Reserve an address, but don't listen on it yet: the probe should not
+	// pass until something actually starts accepting connections there.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := Supervisor{
+		Name:    "supervisor-test-readiness",
+		BinPath: sleepPath,
+		RunDir:  ".",
+		Args:    []string{"2"},
+		ReadinessProbe: &Probe{
+			Check:   &TCPConnectCheck{Address: addr},
+			Period:  20 * time.Millisecond,
+			Timeout: 50 * time.Millisecond,
+		},
+	}
+	if err := s.Supervise(); err != nil {
+		t.Errorf("Failed to start %s: %v", s.Name, err)
+	}
+
+	select {
+	case <-s.Ready():
+		t.Errorf("Ready fired before the port was listening")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ln2, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to start listening on %s: %v", addr, err)
+	}
+	defer ln2.Close()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(1 * time.Second):
+		t.Errorf("Ready did not fire after the port started listening")
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("Failed to stop %s: %v", s.Name, err)
+	}
+}
+
+// TestLivenessProbeTriggersRespawn proves the liveness probe catches a
+// process that's hung but still alive and signalable - the case a naive
+// "is the pid still there" check can't see. SIGSTOP freezes the process
+// without killing it, so it keeps answering kill(pid, 0), but it can no
+// longer serve the HTTP liveness check, which is what should trigger the
+// respawn.
+func TestLivenessProbeTriggersRespawn(t *testing.T) {
+	pythonPath, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not available to run a tiny HTTP server for this test")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := ln.Addr().String()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("failed to split %s: %v", addr, err)
+	}
+	ln.Close()
+
+	s := Supervisor{
+		Name:           "supervisor-test-liveness",
+		BinPath:        pythonPath,
+		RunDir:         ".",
+		Args:           []string{"-m", "http.server", "--bind", "127.0.0.1", port},
+		TimeoutRespawn: 10 * time.Millisecond,
+		LivenessProbe: &Probe{
+			Check: &HTTPGetCheck{URL: "http://" + addr + "/"},
+			// Give the freshly exec'd python3 interpreter time to actually
+			// start serving before the first check, so it isn't killed for
+			// merely being slow to boot rather than for being stalled.
+			InitialDelay:     2 * time.Second,
+			Period:           20 * time.Millisecond,
+			Timeout:          100 * time.Millisecond,
+			FailureThreshold: 2,
+		},
+	}
+	if err := s.Supervise(); err != nil {
+		t.Errorf("Failed to start %s: %v", s.Name, err)
+	}
+	original := s.GetProcess()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("http server at %s never came up: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := original.Signal(syscall.SIGSTOP); err != nil {
+		t.Fatalf("failed to SIGSTOP pid %d: %v", original.Pid, err)
+	}
+
+	deadline = time.Now().Add(4 * time.Second)
+	for time.Now().Before(deadline) {
+		if p := s.GetProcess(); p != nil && p.Pid != original.Pid {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if p := s.GetProcess(); p == nil || p.Pid == original.Pid {
+		t.Errorf("expected the failing liveness probe to trigger a respawn of the stalled pid %d", original.Pid)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("Failed to stop %s: %v", s.Name, err)
+	}
+}
+
+func TestAdoptRunningProcess(t *testing.T) {
+	sleepPath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Errorf("could not find a path for 'sleep' executable: %s", err)
+	}
+
+	name := "supervisor-test-adopt"
+	s := Supervisor{
+		Name:    name,
+		BinPath: sleepPath,
+		RunDir:  ".",
+		Args:    []string{"5"},
+	}
+	if err := s.Supervise(); err != nil {
+		t.Errorf("Failed to start %s: %v", name, err)
+	}
+	original := s.GetProcess()
+
+	// Detach without killing, simulating a k0s restart leaving the child running.
+	if err := s.Detach(); err != nil {
+		t.Errorf("Failed to detach %s: %v", name, err)
+	}
+
+	s2 := Supervisor{
+		Name:    name,
+		BinPath: sleepPath,
+		RunDir:  ".",
+		Args:    []string{"5"},
+	}
+	if err := s2.Supervise(); err != nil {
+		t.Errorf("Failed to start %s: %v", name, err)
+	}
+
+	if adopted := s2.GetProcess(); adopted == nil || adopted.Pid != original.Pid {
+		t.Errorf("Expected to adopt pid %d, got %v", original.Pid, adopted)
+	}
+
+	if err := s2.Stop(); err != nil {
+		t.Errorf("Failed to stop %s: %v", name, err)
+	}
+	if err := original.Signal(syscall.Signal(0)); err == nil {
+		t.Errorf("Expected adopted process %d to be killed by Stop", original.Pid)
+	}
 }